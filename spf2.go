@@ -6,13 +6,18 @@ package libspf2
 
 #include <stdlib.h>
 #include <netdb.h>
+#include <arpa/nameser.h>
 #include <spf2/spf.h>
 */
 import "C"
 
 import (
+	"context"
 	"errors"
 	"net"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -27,27 +32,191 @@ const (
 	SPFResultNONE      = Result(C.SPF_RESULT_NONE)      // none
 )
 
+// QueryOptions holds the parameters for a full MTA-style SPF check: HELO/EHLO
+// domain, envelope sender, client IP and (for the 2mx fallback) the RCPT TO
+// address. Callers performing the full RFC 7208 §2.4 flow for a null sender
+// (empty MAIL FROM) typically try QueryHelo first, then Query2MX.
+type QueryOptions struct {
+	From   string
+	Helo   string
+	IP     net.IP
+	RcptTo string
+}
+
+// Response carries the full outcome of an SPF query: the numeric Result, the
+// reason libspf2 assigned to it, and the strings an SMTP server needs to
+// build a rejection message or a Received-SPF: header.
+type Response struct {
+	Result            Result
+	Reason            string
+	SMTPComment       string
+	Explanation       string
+	ReceivedSPFHeader string
+}
+
 type Client interface {
 	Query(host string, ip net.IP) (Result, error)
+	QueryContext(ctx context.Context, host string, ip net.IP) (Result, error)
+	QueryDetailed(host string, ip net.IP) (*Response, error)
+	QueryHelo(opts QueryOptions) (Result, error)
+	Query2MX(opts QueryOptions) (Result, error)
+	SetRecDom(dom string) error
+	SetMaxDNSMech(max int) error
+	SetMaxDNSPtr(max int) error
 	Close()
 }
 
 type clientImpl struct {
-	s *C.SPF_server_t
+	mu      sync.RWMutex
+	s       *C.SPF_server_t
+	timeout time.Duration
+}
+
+// acquire returns the underlying SPF_server_t, holding a read lock that the
+// caller must release by calling the returned func. Queries hold this lock
+// for as long as they run, so a concurrent Close or SetXxx call (which take
+// the write lock) waits for in-flight queries to finish instead of freeing
+// or mutating the server out from under them.
+func (s *clientImpl) acquire() (*C.SPF_server_t, func(), error) {
+	s.mu.RLock()
+	if s.s == nil {
+		s.mu.RUnlock()
+		return nil, nil, errors.New("client already closed")
+	}
+	return s.s, s.mu.RUnlock, nil
+}
+
+// ClientOption configures a Client at construction time.
+type ClientOption func(*clientImpl)
+
+// WithTimeout sets the default timeout applied by QueryContext when the
+// caller's context does not already carry a deadline.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *clientImpl) {
+		c.timeout = d
+	}
 }
 
 // NewClient creates a new SPF client.
-func NewClient() Client {
+func NewClient(opts ...ClientOption) Client {
 	client := new(clientImpl)
 	client.s = C.SPF_server_new(C.SPF_DNS_CACHE, 0)
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+// NewClientDebug creates a new SPF client with libspf2's debug flag enabled,
+// which makes it log verbose tracing of each evaluation step to stderr. This
+// is the same knob Exim/mopher/postfix policy servers expose for diagnosing
+// SPF record problems.
+func NewClientDebug(opts ...ClientOption) Client {
+	client := new(clientImpl)
+	client.s = C.SPF_server_new(C.SPF_DNS_CACHE, 1)
+	for _, opt := range opts {
+		opt(client)
+	}
 	return client
 }
 
+// DNSResolver abstracts the SPF_dns_server_t chain libspf2 uses to resolve
+// the records an SPF check needs, so a Client can be pointed at something
+// other than live DNS.
+type DNSResolver interface {
+	dnsServer() *C.SPF_dns_server_t
+}
+
+// NewClientWithResolver creates a new SPF client backed by the given
+// DNSResolver instead of libspf2's default caching live-DNS resolver. This is
+// how a ZoneResolver full of fixture records is wired in for table-driven
+// tests covering all eight result codes without touching the network.
+func NewClientWithResolver(r DNSResolver, opts ...ClientOption) Client {
+	client := new(clientImpl)
+	client.s = C.SPF_server_new_dns(r.dnsServer(), 0)
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+// ZoneResolver is a DNSResolver backed by libspf2's in-memory SPF_dns_zone.
+// Register fixture A/AAAA/MX/TXT/SPF/PTR records keyed by name, then pass it
+// to NewClientWithResolver to query against them deterministically.
+type ZoneResolver struct {
+	zone *C.SPF_dns_server_t
+}
+
+// NewZoneResolver creates an empty ZoneResolver.
+func NewZoneResolver() *ZoneResolver {
+	return &ZoneResolver{zone: C.SPF_dns_zone_new(nil, nil, 0)}
+}
+
+func (z *ZoneResolver) dnsServer() *C.SPF_dns_server_t {
+	return z.zone
+}
+
+func (z *ZoneResolver) add(name string, rrType C.ns_type, data string) error {
+	return z.addStat(name, rrType, C.NETDB_SUCCESS, data)
+}
+
+func (z *ZoneResolver) addStat(name string, rrType C.ns_type, herrno C.int, data string) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cdata := C.CString(data)
+	defer C.free(unsafe.Pointer(cdata))
+	stat := C.SPF_dns_zone_add_str(z.zone, cname, rrType, herrno, cdata)
+	if stat != C.SPF_E_SUCCESS {
+		return &SPFError{stat}
+	}
+	return nil
+}
+
+// AddServFail registers name as failing TXT lookups with a transient DNS
+// server failure (TRY_AGAIN), for exercising SPF's temperror handling in
+// table-driven tests without needing a real flaky resolver.
+func (z *ZoneResolver) AddServFail(name string) error {
+	return z.addStat(name, C.ns_t_txt, C.TRY_AGAIN, "")
+}
+
+// AddA registers a synthetic A record for name.
+func (z *ZoneResolver) AddA(name, ip string) error {
+	return z.add(name, C.ns_t_a, ip)
+}
+
+// AddAAAA registers a synthetic AAAA record for name.
+func (z *ZoneResolver) AddAAAA(name, ip string) error {
+	return z.add(name, C.ns_t_aaaa, ip)
+}
+
+// AddMX registers a synthetic MX record for name.
+func (z *ZoneResolver) AddMX(name, host string) error {
+	return z.add(name, C.ns_t_mx, host)
+}
+
+// AddTXT registers a synthetic TXT record for name.
+func (z *ZoneResolver) AddTXT(name, value string) error {
+	return z.add(name, C.ns_t_txt, value)
+}
+
+// AddSPF registers a synthetic record for name using the dedicated (and, per
+// RFC 7208, deprecated) DNS SPF RR type.
+func (z *ZoneResolver) AddSPF(name, value string) error {
+	return z.add(name, C.ns_t_spf, value)
+}
+
+// AddPTR registers a synthetic PTR record for name.
+func (z *ZoneResolver) AddPTR(name, host string) error {
+	return z.add(name, C.ns_t_ptr, host)
+}
+
 func (s *clientImpl) Query(host string, ip net.IP) (Result, error) {
-	if s.s == nil {
-		return SPFResultINVALID, errors.New("client already closed")
+	srv, release, err := s.acquire()
+	if err != nil {
+		return SPFResultINVALID, err
 	}
-	req := newRequest(s)
+	defer release()
+	req := newRequest(srv)
 	defer req.free()
 	if err := req.setEnvFrom(host); err != nil {
 		return SPFResultINVALID, err
@@ -63,7 +232,171 @@ func (s *clientImpl) Query(host string, ip net.IP) (Result, error) {
 	return resp.result(), nil
 }
 
+// QueryContext behaves like Query, but runs the (blocking, cgo) lookup on a
+// worker goroutine and returns ctx.Err() if ctx is cancelled or its deadline
+// passes first. If the client was built with WithTimeout and ctx has no
+// deadline of its own, that default timeout is applied. The worker goroutine
+// keeps running after QueryContext returns so the underlying SPF_request_t
+// and SPF_response_t are still freed once the cgo call completes.
+func (s *clientImpl) QueryContext(ctx context.Context, host string, ip net.IP) (Result, error) {
+	if s.timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.timeout)
+			defer cancel()
+		}
+	}
+
+	type queryResult struct {
+		result Result
+		err    error
+	}
+	done := make(chan queryResult, 1)
+	go func() {
+		result, err := s.Query(host, ip)
+		done <- queryResult{result, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return SPFResultNONE, ctx.Err()
+	case res := <-done:
+		return res.result, res.err
+	}
+}
+
+// QueryDetailed behaves like Query but returns the full Response, including
+// the SMTP comment, explanation and Received-SPF: header text that SMTP
+// servers need to report a rejection or annotate accepted mail.
+func (s *clientImpl) QueryDetailed(host string, ip net.IP) (*Response, error) {
+	srv, release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	req := newRequest(srv)
+	defer req.free()
+	if err := req.setEnvFrom(host); err != nil {
+		return nil, err
+	}
+	if err := req.setIpAddr(ip); err != nil {
+		return nil, err
+	}
+	resp, err := req.query()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.free()
+	return resp.detail(), nil
+}
+
+// QueryHelo performs a HELO-only SPF check, used when the envelope sender
+// (MAIL FROM) is empty, as for bounces and other null-sender messages.
+func (s *clientImpl) QueryHelo(opts QueryOptions) (Result, error) {
+	srv, release, err := s.acquire()
+	if err != nil {
+		return SPFResultINVALID, err
+	}
+	defer release()
+	req := newRequest(srv)
+	defer req.free()
+	if err := req.setIpAddr(opts.IP); err != nil {
+		return SPFResultINVALID, err
+	}
+	if err := req.setHeloDom(opts.Helo); err != nil {
+		return SPFResultINVALID, err
+	}
+	resp, err := req.queryHelo()
+	if err != nil {
+		return SPFResultNONE, err
+	}
+	defer resp.free()
+	return resp.result(), nil
+}
+
+// Query2MX performs the "2mx" best-guess fallback check described in RFC 7208
+// §2.4, used for null-sender messages once the HELO check has also failed to
+// produce a definitive result. The 2mx domain is typically the HELO/EHLO
+// domain presented by the client MTA.
+func (s *clientImpl) Query2MX(opts QueryOptions) (Result, error) {
+	srv, release, err := s.acquire()
+	if err != nil {
+		return SPFResultINVALID, err
+	}
+	defer release()
+	req := newRequest(srv)
+	defer req.free()
+	if err := req.setIpAddr(opts.IP); err != nil {
+		return SPFResultINVALID, err
+	}
+
+	cfrom := C.CString(opts.From)
+	defer C.free(unsafe.Pointer(cfrom))
+	chelo := C.CString(opts.Helo)
+	defer C.free(unsafe.Pointer(chelo))
+	crcptto := C.CString(opts.RcptTo)
+	defer C.free(unsafe.Pointer(crcptto))
+
+	var resp *C.SPF_response_t
+	stat := C.SPF_request_query_fallback(req.r, &resp, cfrom, chelo, crcptto)
+	if stat != C.SPF_E_SUCCESS {
+		return SPFResultNONE, &SPFError{stat}
+	}
+	r := &response{resp}
+	defer r.free()
+	return r.result(), nil
+}
+
+// SetRecDom sets the receiving domain used for SPF's %{r} macro and for the
+// receiver= field of a generated Received-SPF: header.
+func (s *clientImpl) SetRecDom(dom string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s == nil {
+		return errors.New("client already closed")
+	}
+	cdom := C.CString(dom)
+	defer C.free(unsafe.Pointer(cdom))
+	stat := C.SPF_server_set_rec_dom(s.s, cdom)
+	if stat != C.SPF_E_SUCCESS {
+		return &SPFError{stat}
+	}
+	return nil
+}
+
+// SetMaxDNSMech caps the number of DNS-triggering mechanisms and modifiers
+// (a, mx, ptr, exists, include, redirect) a single SPF evaluation may use.
+func (s *clientImpl) SetMaxDNSMech(max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s == nil {
+		return errors.New("client already closed")
+	}
+	stat := C.SPF_server_set_max_dns_mech(s.s, C.int(max))
+	if stat != C.SPF_E_SUCCESS {
+		return &SPFError{stat}
+	}
+	return nil
+}
+
+// SetMaxDNSPtr caps the number of PTR records an SPF "ptr" mechanism may
+// examine.
+func (s *clientImpl) SetMaxDNSPtr(max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s == nil {
+		return errors.New("client already closed")
+	}
+	stat := C.SPF_server_set_max_dns_ptr(s.s, C.int(max))
+	if stat != C.SPF_E_SUCCESS {
+		return &SPFError{stat}
+	}
+	return nil
+}
+
 func (s *clientImpl) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.s != nil {
 		C.SPF_server_free(s.s)
 		s.s = nil
@@ -71,14 +404,12 @@ func (s *clientImpl) Close() {
 }
 
 type request struct {
-	s *clientImpl
 	r *C.SPF_request_t
 }
 
-func newRequest(s *clientImpl) *request {
+func newRequest(srv *C.SPF_server_t) *request {
 	r := new(request)
-	r.s = s
-	r.r = C.SPF_request_new(s.s)
+	r.r = C.SPF_request_new(srv)
 	return r
 }
 
@@ -93,7 +424,7 @@ func (r *request) setIpAddr(ip net.IP) error {
 		stat = C.SPF_request_set_ipv6_str(r.r, cstring)
 	}
 	if stat != C.SPF_E_SUCCESS {
-		return &spfError{stat}
+		return &SPFError{stat}
 	}
 	return nil
 }
@@ -105,7 +436,18 @@ func (r *request) setEnvFrom(from string) error {
 	defer C.free(unsafe.Pointer(cstring))
 	stat = C.SPF_request_set_env_from(r.r, cstring)
 	if stat != C.int(C.SPF_E_SUCCESS) {
-		return &spfError{C.SPF_errcode_t(stat)}
+		return &SPFError{C.SPF_errcode_t(stat)}
+	}
+	return nil
+}
+
+// SetHeloDom sets the HELO/EHLO domain presented by the client (sending) MTA
+func (r *request) setHeloDom(helo string) error {
+	cstring := C.CString(helo)
+	defer C.free(unsafe.Pointer(cstring))
+	stat := C.SPF_request_set_helo_dom(r.r, cstring)
+	if stat != C.SPF_E_SUCCESS {
+		return &SPFError{stat}
 	}
 	return nil
 }
@@ -116,7 +458,18 @@ func (r *request) query() (*response, error) {
 	var resp *C.SPF_response_t
 	stat = C.SPF_request_query_mailfrom(r.r, &resp)
 	if stat != C.SPF_E_SUCCESS {
-		return nil, &spfError{stat}
+		return nil, &SPFError{stat}
+	}
+	return &response{resp}, nil
+}
+
+// queryHelo starts the HELO-only SPF query
+func (r *request) queryHelo() (*response, error) {
+	var stat C.SPF_errcode_t
+	var resp *C.SPF_response_t
+	stat = C.SPF_request_query_helo(r.r, &resp)
+	if stat != C.SPF_E_SUCCESS {
+		return nil, &SPFError{stat}
 	}
 	return &response{resp}, nil
 }
@@ -138,6 +491,39 @@ func (r *response) result() Result {
 	return Result(C.SPF_response_result(r.r))
 }
 
+// receivedSPFInternalErrorMarker is the telltale substring of the header
+// text libspf2 sometimes returns from SPF_response_get_received_spf instead
+// of a real header when it hits its known "internal error" bug. Matched as
+// a substring rather than an exact string, since the surrounding wording is
+// not guaranteed to be stable across libspf2 versions.
+const receivedSPFInternalErrorMarker = "internal error"
+
+// cString returns the Go string for a possibly-NULL C string, or def if s is
+// NULL.
+func cString(s *C.char, def string) string {
+	if s == nil {
+		return def
+	}
+	return C.GoString(s)
+}
+
+// detail builds a Response with the full set of libspf2-reported fields,
+// guarding against the known NULL/sentinel cases in
+// SPF_response_get_received_spf.
+func (r *response) detail() *Response {
+	header := cString(C.SPF_response_get_received_spf(r.r), "")
+	if strings.Contains(header, receivedSPFInternalErrorMarker) {
+		header = ""
+	}
+	return &Response{
+		Result:            r.result(),
+		Reason:            C.GoString(C.SPF_strreason(C.SPF_response_reason(r.r))),
+		SMTPComment:       cString(C.SPF_response_get_smtp_comment(r.r), ""),
+		Explanation:       cString(C.SPF_response_get_explanation(r.r), ""),
+		ReceivedSPFHeader: header,
+	}
+}
+
 // Free frees the response handle
 func (r *response) free() {
 	if r.r != nil {
@@ -152,10 +538,55 @@ func (r Result) String() string {
 	return C.GoString(C.SPF_strresult(C.SPF_result_t(r)))
 }
 
-type spfError struct {
+// Sentinel errors classifying the SPF_errcode_t values libspf2 can return,
+// so callers can branch with errors.Is instead of matching SPF_strerror's
+// human-readable text. This mirrors how pure-Go SPF libraries like
+// blitiri.com.ar/go/spf surface failures, and lets an SMTP integration
+// decide between a 4xx defer (temporary/DNS) and a 5xx reject (permanent).
+var (
+	ErrDNSTimeout = errors.New("spf: dns lookup failed or timed out")
+	ErrInvalidIP  = errors.New("spf: invalid IP address")
+	ErrNoRecord   = errors.New("spf: no SPF record found")
+	ErrSyntax     = errors.New("spf: malformed SPF record")
+	ErrPermError  = errors.New("spf: permanent error evaluating SPF record")
+	ErrTempError  = errors.New("spf: temporary error evaluating SPF record")
+)
+
+// errCodeClass maps an SPF_errcode_t to the sentinel error it corresponds
+// to. Codes with no entry here still produce a working SPFError; they just
+// don't match any of the sentinels via errors.Is. No code maps to
+// ErrTempError, so errors.Is(err, ErrTempError) is false for every SPFError;
+// a DNS failure (SPF_E_DNS_ERROR) matches ErrDNSTimeout only.
+var errCodeClass = map[C.SPF_errcode_t]error{
+	C.SPF_E_DNS_ERROR:      ErrDNSTimeout,
+	C.SPF_E_INVALID_IP4:    ErrInvalidIP,
+	C.SPF_E_INVALID_IP6:    ErrInvalidIP,
+	C.SPF_E_NOT_SPF:        ErrNoRecord,
+	C.SPF_E_SYNTAX:         ErrSyntax,
+	C.SPF_E_INTERNAL_ERROR: ErrPermError,
+}
+
+// SPFError wraps the SPF_errcode_t returned by a libspf2 call.
+type SPFError struct {
 	code C.SPF_errcode_t
 }
 
-func (e *spfError) Error() string {
+func (e *SPFError) Error() string {
 	return C.GoString(C.SPF_strerror(e.code))
 }
+
+// Code returns the raw libspf2 SPF_errcode_t, for callers that need more
+// detail than the sentinel errors provide.
+func (e *SPFError) Code() int {
+	return int(e.code)
+}
+
+// Is supports errors.Is(err, ErrInvalidIP) and friends by mapping this
+// error's SPF_errcode_t to its sentinel error class.
+func (e *SPFError) Is(target error) bool {
+	class, ok := errCodeClass[e.code]
+	if !ok {
+		return false
+	}
+	return class == target
+}
@@ -0,0 +1,64 @@
+package libspf2
+
+import (
+	"net"
+	"testing"
+)
+
+// TestZoneResolverAllResultCodes exercises every SPFResult* code through a
+// ZoneResolver, proving the fixture-backed DNS path (SPF_dns_zone_new,
+// SPF_dns_zone_add_str, SPF_server_new_dns) actually works end to end
+// without touching the network.
+func TestZoneResolverAllResultCodes(t *testing.T) {
+	z := NewZoneResolver()
+
+	records := []struct {
+		domain string
+		spf    string
+	}{
+		{"pass.example.com", "v=spf1 +all"},
+		{"fail.example.com", "v=spf1 -all"},
+		{"softfail.example.com", "v=spf1 ~all"},
+		{"neutral.example.com", "v=spf1 ?all"},
+		{"permerror.example.com", "v=spf1 bogusmech -all"},
+	}
+	for _, r := range records {
+		if err := z.AddTXT(r.domain, r.spf); err != nil {
+			t.Fatalf("AddTXT(%s): %v", r.domain, err)
+		}
+	}
+	if err := z.AddServFail("temperror.example.com"); err != nil {
+		t.Fatalf("AddServFail: %v", err)
+	}
+	// none.example.com is intentionally left unregistered: no SPF record
+	// exists for it at all.
+
+	client := NewClientWithResolver(z)
+	defer client.Close()
+
+	ip := net.ParseIP("192.0.2.1")
+
+	cases := []struct {
+		name string
+		from string
+		want Result
+	}{
+		{"pass", "user@pass.example.com", SPFResultPASS},
+		{"fail", "user@fail.example.com", SPFResultFAIL},
+		{"softfail", "user@softfail.example.com", SPFResultSOFTFAIL},
+		{"neutral", "user@neutral.example.com", SPFResultNEUTRAL},
+		{"none", "user@none.example.com", SPFResultNONE},
+		{"permerror", "user@permerror.example.com", SPFResultPERMERROR},
+		{"temperror", "user@temperror.example.com", SPFResultTEMPERROR},
+		{"invalid", "not-an-email-address", SPFResultINVALID},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, _ := client.Query(c.from, ip)
+			if got != c.want {
+				t.Errorf("Query(%q) = %v, want %v", c.from, got, c.want)
+			}
+		})
+	}
+}